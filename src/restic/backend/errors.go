@@ -0,0 +1,11 @@
+package backend
+
+import "os"
+
+// IsNotExist returns true if err indicates that a requested file does not
+// exist in the backend, as opposed to some other failure (e.g. a
+// transient I/O or permission error) that callers should propagate
+// instead of silently treating as "nothing here yet".
+func IsNotExist(err error) bool {
+	return os.IsNotExist(err)
+}
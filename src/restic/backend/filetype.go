@@ -0,0 +1,26 @@
+package backend
+
+// FileType distinguishes the different kinds of files stored in a
+// repository's backend.
+type FileType string
+
+// These are the different data types a backend can store.
+const (
+	Data     FileType = "data"
+	Key      FileType = "key"
+	Lock     FileType = "lock"
+	Snapshot FileType = "snapshot"
+	Index    FileType = "index"
+	Config   FileType = "config"
+
+	// Checkpoint identifies the resumable progress file written by
+	// index.NewIncremental, so that an interrupted rebuild can skip the
+	// packs it already scanned on the next run.
+	Checkpoint FileType = "checkpoint"
+
+	// Filter identifies the bloom filter sidecars index.Index saves
+	// alongside an index, in their own namespace rather than decorated
+	// names under Index, so that enumerating Index never has to account
+	// for non-index entries mixed in.
+	Filter FileType = "filter"
+)
@@ -0,0 +1,171 @@
+package index
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+	"restic"
+	"restic/pack"
+)
+
+// defaultFalsePositiveRate is the target false-positive rate used for the
+// bloom filter built alongside every index, unless a caller overrides it.
+const defaultFalsePositiveRate = 0.001
+
+// bloomFilter is a fixed-size bit array with k independent hash functions,
+// used to accelerate negative blob-membership queries against an Index
+// without paying the memory cost of a full map lookup. False positives are
+// possible, false negatives are not: if Has reports false, the blob is
+// guaranteed not to be present.
+type bloomFilter struct {
+	bits []uint64
+	m    uint64 // number of bits
+	k    uint64 // number of hash functions
+}
+
+// newBloomFilter returns a bloom filter sized for n elements at the given
+// target false-positive rate. For n == 0 a minimal filter is returned so
+// that empty indexes don't need special-casing.
+func newBloomFilter(n int, falsePositiveRate float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+
+	m := optimalM(n, falsePositiveRate)
+	k := optimalK(n, m)
+
+	return &bloomFilter{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+func optimalM(n int, p float64) uint64 {
+	m := math.Ceil(-1 * float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	if m < 64 {
+		m = 64
+	}
+	return uint64(m)
+}
+
+func optimalK(n int, m uint64) uint64 {
+	k := math.Round(float64(m) / float64(n) * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+	return uint64(k)
+}
+
+// keyHashes returns the two base hashes used to derive the k probe
+// positions for id/t via double hashing (Kirsch-Mitzenmacher).
+func keyHashes(id restic.ID, t pack.BlobType) (h1, h2 uint64) {
+	h := fnv.New64a()
+	h.Write(id[:])
+	h.Write([]byte{byte(t)})
+	sum := h.Sum(nil)
+
+	h1 = binary.BigEndian.Uint64(sum)
+	h.Reset()
+	h.Write(sum)
+	h2 = binary.BigEndian.Uint64(h.Sum(nil))
+
+	return h1, h2
+}
+
+func (f *bloomFilter) positions(id restic.ID, t pack.BlobType) []uint64 {
+	h1, h2 := keyHashes(id, t)
+	positions := make([]uint64, f.k)
+	for i := uint64(0); i < f.k; i++ {
+		positions[i] = (h1 + i*h2) % f.m
+	}
+	return positions
+}
+
+// Add records id/t as present in the filter.
+func (f *bloomFilter) Add(id restic.ID, t pack.BlobType) {
+	for _, pos := range f.positions(id, t) {
+		f.bits[pos/64] |= 1 << (pos % 64)
+	}
+}
+
+// Has returns false if id/t is definitely not in the filter. A true result
+// means id/t is probably present and must be confirmed against the real
+// index.
+func (f *bloomFilter) Has(id restic.ID, t pack.BlobType) bool {
+	for _, pos := range f.positions(id, t) {
+		if f.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// errBloomDimensionMismatch is returned by Merge when other was built with
+// different (m, k) parameters, e.g. because it is the sidecar of a
+// differently-sized index. The two bit arrays are not comparable in that
+// case, so the caller must not treat f as valid.
+var errBloomDimensionMismatch = errors.New("bloom filter dimension mismatch")
+
+// Merge ORs other's bits into f. Both filters must have identical
+// dimensions (m, k), as produced by loading sidecars built with the same
+// parameters; otherwise errBloomDimensionMismatch is returned and f is
+// left unmodified.
+func (f *bloomFilter) Merge(other *bloomFilter) error {
+	if other.m != f.m || other.k != f.k {
+		return errBloomDimensionMismatch
+	}
+
+	for i := range f.bits {
+		f.bits[i] |= other.bits[i]
+	}
+
+	return nil
+}
+
+// bloomFilterMagic identifies the binary encoding used by
+// MarshalBinary/UnmarshalBinary, so a future format change can be detected
+// instead of silently misparsed.
+const bloomFilterMagic = "rbf1"
+
+// MarshalBinary encodes the filter as: magic, m, k, then the bit array.
+func (f *bloomFilter) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 0, len(bloomFilterMagic)+16+len(f.bits)*8)
+	buf = append(buf, bloomFilterMagic...)
+	buf = appendUint64(buf, f.m)
+	buf = appendUint64(buf, f.k)
+	for _, word := range f.bits {
+		buf = appendUint64(buf, word)
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a filter encoded by MarshalBinary.
+func (f *bloomFilter) UnmarshalBinary(data []byte) error {
+	if len(data) < len(bloomFilterMagic)+16 || string(data[:len(bloomFilterMagic)]) != bloomFilterMagic {
+		return errors.New("invalid bloom filter encoding")
+	}
+	data = data[len(bloomFilterMagic):]
+
+	f.m = binary.BigEndian.Uint64(data[:8])
+	f.k = binary.BigEndian.Uint64(data[8:16])
+	data = data[16:]
+
+	if uint64(len(data)) != (f.m+63)/64*8 {
+		return errors.New("invalid bloom filter encoding: truncated bit array")
+	}
+
+	f.bits = make([]uint64, (f.m+63)/64)
+	for i := range f.bits {
+		f.bits[i] = binary.BigEndian.Uint64(data[i*8 : i*8+8])
+	}
+
+	return nil
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
@@ -0,0 +1,335 @@
+package index
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"restic/backend"
+	"restic/debug"
+	"restic/pack"
+	"restic/repository"
+	"sync"
+)
+
+// DefaultCheckpointEvery is the number of packs processed between
+// checkpoints when none is configured in RebuildOptions.
+const DefaultCheckpointEvery = 10000
+
+// DefaultWorkers is the number of concurrent pack-scanning goroutines used
+// when none is configured in RebuildOptions.
+const DefaultWorkers = 8
+
+// checkpointName is the fixed name under which the single in-progress
+// rebuild checkpoint for a repo is stored. There is only ever one
+// concurrent rebuild per repo, so no further disambiguation is needed.
+const checkpointName = "index-rebuild"
+
+// RebuildOptions configures NewIncremental.
+type RebuildOptions struct {
+	// Workers is the number of pack files scanned concurrently. Defaults
+	// to DefaultWorkers when zero.
+	Workers int
+
+	// CheckpointEvery is the number of newly-scanned packs after which a
+	// partial index is saved to the backend and the checkpoint file is
+	// updated. Defaults to DefaultCheckpointEvery when zero.
+	CheckpointEvery int
+}
+
+// checkpointState is the on-disk representation of rebuild progress,
+// stored as backend.Checkpoint so that a later call to NewIncremental can
+// resume instead of rescanning every pack from scratch.
+type checkpointState struct {
+	ProcessedPacks backend.IDs `json:"processed_packs"`
+	IndexIDs       backend.IDs `json:"index_ids"`
+}
+
+// packResult is sent back from a scan worker to the collector goroutine.
+type packResult struct {
+	id      backend.ID
+	entries []pack.Blob
+	err     error
+}
+
+// testOnAfterPack, when non-nil, is called after every pack is scanned and
+// recorded as processed, with the total number processed so far. It exists
+// so tests can deterministically interrupt a rebuild partway through
+// instead of relying on timing.
+var testOnAfterPack func(processed int)
+
+// NewIncremental builds an index the same way New does, but streams
+// partial indexes to the backend every opts.CheckpointEvery packs and
+// records progress in a checkpoint file under backend.Checkpoint. If a
+// checkpoint from a previous, interrupted run is found, already-processed
+// packs are skipped. Pack scanning itself is parallelized across
+// opts.Workers goroutines.
+//
+// The returned Index is equivalent to the one New would produce: a
+// transient backend failure only loses the packs scanned since the last
+// checkpoint, not the whole rebuild.
+//
+// The per-batch indexes saved at each checkpoint do not get a bloom
+// filter sidecar (see saveIndexOnly): a repo built up this way will have
+// Index.filter rebuilt by a full Blobs rescan on its next Load(), the
+// same as loading any other index missing a sidecar. Save() writes a new
+// index with a sidecar but does not remove the indexes it supersedes;
+// Load() skips that rescan only once every index it reads has a sidecar
+// of matching dimensions.
+func NewIncremental(ctx context.Context, repo *repository.Repository, opts RebuildOptions) (*Index, error) {
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultWorkers
+	}
+	if opts.CheckpointEvery <= 0 {
+		opts.CheckpointEvery = DefaultCheckpointEvery
+	}
+
+	idx := &Index{
+		Packs:    make(map[backend.ID]Pack),
+		Blobs:    make(map[backend.ID]map[pack.BlobType]Blob),
+		IndexIDs: backend.NewIDSet(),
+	}
+
+	state, err := loadCheckpoint(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	processed := backend.NewIDSet()
+	for _, id := range state.ProcessedPacks {
+		processed.Insert(id)
+	}
+
+	for _, id := range state.IndexIDs {
+		if err := idx.loadIndexBlob(repo, id); err != nil {
+			return nil, fmt.Errorf("loading checkpointed index %v: %v", id.Str(), err)
+		}
+		idx.IndexIDs.Insert(id)
+	}
+
+	var toScan backend.IDs
+	done := make(chan struct{})
+	for packID := range repo.List(backend.Data, done) {
+		if !processed.Has(packID) {
+			toScan = append(toScan, packID)
+		}
+	}
+	close(done)
+
+	if err := rebuildStream(ctx, repo, idx, toScan, processed, &state, opts); err != nil {
+		return nil, err
+	}
+
+	idx.buildFilter()
+
+	// The rebuild completed in full, so the checkpoint no longer needs to
+	// be resumed from; clear it rather than leaving it to be replayed by
+	// the next call via loadIndexBlob, which would hard-fail if those
+	// partial index blobs are later pruned.
+	if err := deleteCheckpoint(repo); err != nil {
+		debug.Log("index.NewIncremental", "removing completed checkpoint: %v", err)
+	}
+
+	return idx, nil
+}
+
+// rebuildStream scans toScan with opts.Workers concurrent workers, storing
+// every result into idx and saving a checkpoint every opts.CheckpointEvery
+// packs.
+func rebuildStream(ctx context.Context, repo *repository.Repository, idx *Index, toScan backend.IDs, processed backend.IDSet, state *checkpointState, opts RebuildOptions) error {
+	// ctx is cancelled locally (in addition to whatever the caller does)
+	// so that a scan error unblocks the dispatcher and any workers
+	// currently blocked sending on jobs/results, instead of leaking them.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan backend.ID)
+	results := make(chan packResult)
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range jobs {
+				entries, err := repo.ListPack(id)
+				select {
+				case results <- packResult{id: id, entries: entries, err: err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for _, id := range toScan {
+			select {
+			case jobs <- id:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	pending := make(map[backend.ID][]pack.Blob)
+	sinceCheckpoint := 0
+
+	for res := range results {
+		if res.err != nil {
+			// Unblock the dispatcher and any workers still waiting to
+			// send, then drain results until the wg.Wait goroutine
+			// closes it, so nothing here is left running.
+			cancel()
+			for range results {
+			}
+			return res.err
+		}
+
+		idx.storePack(res.id, res.entries)
+		pending[res.id] = res.entries
+		processed.Insert(res.id)
+		sinceCheckpoint++
+
+		if testOnAfterPack != nil {
+			testOnAfterPack(len(processed))
+		}
+
+		if sinceCheckpoint >= opts.CheckpointEvery {
+			if err := checkpointNow(repo, idx, state, processed, pending); err != nil {
+				return err
+			}
+			pending = make(map[backend.ID][]pack.Blob)
+			sinceCheckpoint = 0
+		}
+	}
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		// Save whatever was scanned before the caller's context was
+		// cancelled, so the next run can resume from here. If that save
+		// itself fails, the caller must be told: otherwise it would see
+		// only ctxErr and wrongly assume the in-flight progress was
+		// persisted.
+		if err := checkpointNow(repo, idx, state, processed, pending); err != nil {
+			return fmt.Errorf("rebuild cancelled (%v) and saving checkpoint failed: %v", ctxErr, err)
+		}
+		return ctxErr
+	}
+
+	if len(pending) > 0 {
+		if err := checkpointNow(repo, idx, state, processed, pending); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkpointNow saves pending as a new partial index superseding nothing,
+// appends it to state.IndexIDs, and writes the updated checkpoint to the
+// backend.
+func checkpointNow(repo *repository.Repository, idx *Index, state *checkpointState, processed backend.IDSet, pending map[backend.ID][]pack.Blob) error {
+	if len(pending) == 0 {
+		return saveCheckpoint(repo, state)
+	}
+
+	// saveIndexOnly, not Save: a per-batch filter sidecar here would be
+	// sized for this batch alone and could never merge with its siblings
+	// in loadFilter (see saveIndexOnly's doc comment).
+	indexID, err := saveIndexOnly(repo, pending, nil)
+	if err != nil {
+		return err
+	}
+
+	state.IndexIDs = append(state.IndexIDs, indexID)
+	idx.IndexIDs.Insert(indexID)
+
+	state.ProcessedPacks = state.ProcessedPacks[:0]
+	for id := range processed {
+		state.ProcessedPacks = append(state.ProcessedPacks, id)
+	}
+
+	debug.Log("index.checkpointNow", "saved checkpoint: %d packs processed, %d partial indexes", len(state.ProcessedPacks), len(state.IndexIDs))
+
+	return saveCheckpoint(repo, state)
+}
+
+// loadIndexBlob decodes the index with the given id and merges its
+// contents into idx, without touching idx.IndexIDs.
+func (idx *Index) loadIndexBlob(repo *repository.Repository, id backend.ID) error {
+	rd, err := repo.GetDecryptReader(backend.Index, id.String())
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	var idxJSON indexJSON
+	if err := json.NewDecoder(rd).Decode(&idxJSON); err != nil {
+		return err
+	}
+
+	for _, p := range idxJSON.Packs {
+		idx.storePack(p.ID, blobsFromJSON(p.Blobs))
+	}
+
+	return nil
+}
+
+// loadCheckpoint reads the checkpoint file left by a previous, possibly
+// interrupted, call to NewIncremental. A missing checkpoint is not an
+// error: it just means this is the first run.
+func loadCheckpoint(repo *repository.Repository) (checkpointState, error) {
+	rd, err := repo.Backend().Get(backend.Checkpoint, checkpointName)
+	if err != nil {
+		if backend.IsNotExist(err) {
+			return checkpointState{}, nil
+		}
+		return checkpointState{}, fmt.Errorf("loading checkpoint: %v", err)
+	}
+	defer rd.Close()
+
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		return checkpointState{}, err
+	}
+
+	var state checkpointState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return checkpointState{}, fmt.Errorf("invalid checkpoint: %v", err)
+	}
+
+	return state, nil
+}
+
+// deleteCheckpoint removes the checkpoint file, marking the rebuild it
+// belonged to as done rather than interrupted. It is not an error for the
+// checkpoint to already be absent (e.g. a rebuild that never needed one).
+func deleteCheckpoint(repo *repository.Repository) error {
+	err := repo.Backend().Remove(backend.Checkpoint, checkpointName)
+	if err != nil && backend.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// saveCheckpoint writes state to the backend, overwriting any previous
+// checkpoint.
+func saveCheckpoint(repo *repository.Repository, state *checkpointState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	if err := repo.Backend().Remove(backend.Checkpoint, checkpointName); err != nil {
+		debug.Log("index.saveCheckpoint", "removing previous checkpoint: %v", err)
+	}
+
+	_, err = repo.Backend().Save(backend.Checkpoint, checkpointName, data)
+	return err
+}
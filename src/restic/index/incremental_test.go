@@ -0,0 +1,132 @@
+package index
+
+import (
+	"context"
+	"restic/backend"
+	"testing"
+)
+
+// TestIndexIncrementalResume verifies that interrupting NewIncremental
+// partway through and calling it again produces an index identical to a
+// single uninterrupted New run, by using testOnAfterPack to cancel the
+// rebuild deterministically once roughly half of the packs have been
+// scanned.
+func TestIndexIncrementalResume(t *testing.T) {
+	repo, cleanup := createFilledRepo(t, 3, 0)
+	defer cleanup()
+
+	full, err := New(repo)
+	if err != nil {
+		t.Fatalf("New() returned error %v", err)
+	}
+	total := len(full.Packs)
+	if total < 2 {
+		t.Skip("not enough packs in fixture to test a partial rebuild")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() { testOnAfterPack = nil }()
+	testOnAfterPack = func(processed int) {
+		if processed >= total/2 {
+			cancel()
+		}
+	}
+
+	opts := RebuildOptions{Workers: 2, CheckpointEvery: 1}
+	_, err = NewIncremental(ctx, repo, opts)
+	if err == nil {
+		t.Fatalf("expected NewIncremental to report the cancellation, got nil error")
+	}
+
+	state, err := loadCheckpoint(repo)
+	if err != nil {
+		t.Fatalf("loadCheckpoint() returned error %v", err)
+	}
+	if len(state.ProcessedPacks) == 0 || len(state.ProcessedPacks) >= total {
+		t.Fatalf("expected a partial checkpoint, got %d/%d packs processed", len(state.ProcessedPacks), total)
+	}
+
+	testOnAfterPack = nil
+
+	resumed, err := NewIncremental(context.Background(), repo, opts)
+	if err != nil {
+		t.Fatalf("resumed NewIncremental() returned error %v", err)
+	}
+
+	if len(resumed.Packs) != len(full.Packs) {
+		t.Errorf("resumed index has %d packs, want %d", len(resumed.Packs), len(full.Packs))
+	}
+
+	for id, p := range full.Packs {
+		rp, ok := resumed.Packs[id]
+		if !ok {
+			t.Errorf("resumed index is missing pack %v", id.Str())
+			continue
+		}
+		if len(rp.Entries) != len(p.Entries) {
+			t.Errorf("pack %v: resumed index has %d entries, want %d", id.Str(), len(rp.Entries), len(p.Entries))
+		}
+	}
+
+	for id := range full.Blobs {
+		if _, ok := resumed.Blobs[id]; !ok {
+			t.Errorf("resumed index is missing blob %v", id.Str())
+		}
+	}
+}
+
+// TestIndexIncrementalNoPerBatchFilter verifies that the partial indexes
+// saved at each checkpoint don't get a bloom filter sidecar (since
+// differently-sized batches could never merge their filters in
+// loadFilter), and that Load() still works afterwards by falling back to
+// buildFilter() instead of erroring out.
+func TestIndexIncrementalNoPerBatchFilter(t *testing.T) {
+	repo, cleanup := createFilledRepo(t, 3, 0)
+	defer cleanup()
+
+	opts := RebuildOptions{Workers: 2, CheckpointEvery: 1}
+	idx, err := NewIncremental(context.Background(), repo, opts)
+	if err != nil {
+		t.Fatalf("NewIncremental() returned error %v", err)
+	}
+	if len(idx.IndexIDs) < 2 {
+		t.Skip("not enough packs in fixture to produce multiple checkpoint batches")
+	}
+
+	for id := range idx.IndexIDs {
+		if _, err := repo.Backend().Get(backend.Filter, id.String()); err == nil {
+			t.Errorf("index %v from a checkpoint batch unexpectedly has a filter sidecar", id.Str())
+		}
+	}
+
+	loaded, err := Load(repo)
+	if err != nil {
+		t.Fatalf("Load() returned error %v", err)
+	}
+
+	for id, types := range loaded.Blobs {
+		for bt := range types {
+			if !loaded.Has(id, bt) {
+				t.Errorf("Has() reported a false negative for blob %v (%v) after loading a checkpointed index without filter sidecars", id.Str(), bt)
+			}
+		}
+	}
+}
+
+func BenchmarkIndexNewIncremental(b *testing.B) {
+	repo, cleanup := createFilledRepo(b, 3, 0)
+	defer cleanup()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		idx, err := NewIncremental(context.Background(), repo, RebuildOptions{})
+		if err != nil {
+			b.Fatalf("NewIncremental() returned error %v", err)
+		}
+
+		if idx == nil {
+			b.Fatalf("NewIncremental() returned nil index")
+		}
+	}
+}
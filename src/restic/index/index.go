@@ -0,0 +1,370 @@
+// Package index implements the in-memory and on-disk representation of the
+// repository index: a lookup table that maps blob IDs to the packs that
+// contain them, so that commands like restore, backup (dedup) and check
+// don't need to read every pack header from the backend.
+package index
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"restic"
+	"restic/backend"
+	"restic/debug"
+	"restic/pack"
+	"restic/repository"
+)
+
+// Pack contains information about the contents of a pack.
+type Pack struct {
+	ID      backend.ID
+	Entries []pack.Blob
+}
+
+// Blob contains information about a blob.
+type Blob struct {
+	Type   pack.BlobType
+	Length uint
+	Offset uint
+	PackID backend.ID
+}
+
+// Index contains information about blobs and packs stored in a repo.
+type Index struct {
+	Packs    map[backend.ID]Pack
+	Blobs    map[backend.ID]map[pack.BlobType]Blob
+	IndexIDs backend.IDSet
+
+	// filter accelerates negative membership queries (does this blob
+	// already exist?) without touching the Blobs map. It is best-effort:
+	// a nil filter (e.g. on an Index built as a struct literal rather
+	// than through New, Load or NewIncremental) simply disables the fast
+	// path and every lookup falls back to Blobs.
+	filter *bloomFilter
+}
+
+// New creates a new index by reading all pack files from the repo.
+func New(repo *repository.Repository) (*Index, error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	idx := &Index{
+		Packs:    make(map[backend.ID]Pack),
+		Blobs:    make(map[backend.ID]map[pack.BlobType]Blob),
+		IndexIDs: backend.NewIDSet(),
+	}
+
+	for packID := range repo.List(backend.Data, done) {
+		entries, err := repo.ListPack(packID)
+		if err != nil {
+			return nil, err
+		}
+
+		idx.storePack(packID, entries)
+	}
+
+	idx.buildFilter()
+
+	return idx, nil
+}
+
+// storePack records the blobs contained in a pack.
+func (idx *Index) storePack(id backend.ID, entries []pack.Blob) {
+	idx.Packs[id] = Pack{ID: id, Entries: entries}
+
+	for _, entry := range entries {
+		if _, ok := idx.Blobs[entry.ID]; !ok {
+			idx.Blobs[entry.ID] = make(map[pack.BlobType]Blob)
+		}
+
+		idx.Blobs[entry.ID][entry.Type] = Blob{
+			Type:   entry.Type,
+			Length: entry.Length,
+			Offset: entry.Offset,
+			PackID: id,
+		}
+	}
+}
+
+// AddPack records a pack that was not yet part of the index, e.g. one just
+// written out by the archiver, and keeps the bloom filter consistent with
+// it. Callers that add packs to a live Index after New/Load (instead of
+// building a fresh one) must go through AddPack rather than mutating Packs
+// and Blobs directly: storePack alone does not touch the filter, so blobs
+// added that way would be invisible to Has() and wrongly reported absent.
+func (idx *Index) AddPack(id backend.ID, entries []pack.Blob) {
+	idx.storePack(id, entries)
+
+	if idx.filter == nil {
+		return
+	}
+
+	for _, entry := range entries {
+		idx.filter.Add(entry.ID, entry.Type)
+	}
+}
+
+// Has returns true if the blob with the given id and type is contained in
+// the index. When a bloom filter is available it is consulted first so
+// that the (much more common) negative case does not require touching the
+// Blobs map at all. Has is only accurate for blobs added via New, Load,
+// NewIncremental or AddPack; packs stored directly through storePack
+// bypass the filter.
+func (idx *Index) Has(id restic.ID, t pack.BlobType) bool {
+	if idx.filter != nil && !idx.filter.Has(id, t) {
+		return false
+	}
+
+	types, ok := idx.Blobs[id]
+	if !ok {
+		return false
+	}
+
+	_, ok = types[t]
+	return ok
+}
+
+// DuplicateBlobs returns a list of blobs that are stored more than once in
+// the repo.
+func (idx *Index) DuplicateBlobs() (dups backend.IDSet) {
+	dups = backend.NewIDSet()
+	seen := backend.NewIDSet()
+
+	for _, p := range idx.Packs {
+		for _, entry := range p.Entries {
+			if seen.Has(entry.ID) {
+				dups.Insert(entry.ID)
+			}
+			seen.Insert(entry.ID)
+		}
+	}
+
+	return dups
+}
+
+// PacksForBlobs returns the set of packs that contain at least one of the
+// given blobs.
+func (idx *Index) PacksForBlobs(blobs backend.IDSet) (packs backend.IDSet) {
+	packs = backend.NewIDSet()
+
+	for id := range blobs {
+		for packID, p := range idx.Packs {
+			for _, entry := range p.Entries {
+				if entry.ID.Equal(id) {
+					packs.Insert(packID)
+				}
+			}
+		}
+	}
+
+	return packs
+}
+
+// buildFilter (re-)builds the bloom filter from the current Blobs map. It
+// is called after New() has scanned all packs and after Load() has
+// reconstructed an index from the backend without a filter sidecar.
+func (idx *Index) buildFilter() {
+	idx.filter = newBloomFilter(len(idx.Blobs), defaultFalsePositiveRate)
+	for id, types := range idx.Blobs {
+		for t := range types {
+			idx.filter.Add(id, t)
+		}
+	}
+}
+
+// indexJSON is the on-disk format for an index.
+type indexJSON struct {
+	Supersedes backend.IDs `json:"supersedes,omitempty"`
+	Packs      []packJSON  `json:"packs"`
+}
+
+type packJSON struct {
+	ID    backend.ID `json:"id"`
+	Blobs []blobJSON `json:"blobs"`
+}
+
+type blobJSON struct {
+	ID     backend.ID    `json:"id"`
+	Type   pack.BlobType `json:"type"`
+	Offset uint          `json:"offset"`
+	Length uint          `json:"length"`
+}
+
+// Load creates an index by loading all index files from the repo.
+func Load(repo *repository.Repository) (*Index, error) {
+	debug.Log("index.Load", "loading indexes")
+
+	idx := &Index{
+		Packs:    make(map[backend.ID]Pack),
+		Blobs:    make(map[backend.ID]map[pack.BlobType]Blob),
+		IndexIDs: backend.NewIDSet(),
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	for id := range repo.List(backend.Index, done) {
+		debug.Log("index.Load", "process index %v", id.Str())
+
+		rd, err := repo.GetDecryptReader(backend.Index, id.String())
+		if err != nil {
+			return nil, err
+		}
+
+		var idxJSON indexJSON
+		err = json.NewDecoder(rd).Decode(&idxJSON)
+		rd.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error decoding index %v: %v", id.Str(), err)
+		}
+
+		for _, p := range idxJSON.Packs {
+			idx.storePack(p.ID, blobsFromJSON(p.Blobs))
+		}
+
+		idx.IndexIDs.Insert(id)
+	}
+
+	if err := idx.loadFilter(repo); err != nil {
+		debug.Log("index.Load", "unable to load bloom filter, rebuilding: %v", err)
+		idx.buildFilter()
+	}
+
+	return idx, nil
+}
+
+func blobsFromJSON(blobs []blobJSON) []pack.Blob {
+	entries := make([]pack.Blob, 0, len(blobs))
+	for _, b := range blobs {
+		entries = append(entries, pack.Blob{
+			ID:     b.ID,
+			Type:   b.Type,
+			Offset: b.Offset,
+			Length: b.Length,
+		})
+	}
+	return entries
+}
+
+// Save writes a new index containing the given packs to the repo, along
+// with a bloom filter sidecar. The new index supersedes the indexes with
+// the ids given in supersedes.
+func Save(repo *repository.Repository, packs map[backend.ID][]pack.Blob, supersedes backend.IDs) (backend.ID, error) {
+	return save(repo, packs, supersedes, true)
+}
+
+// saveIndexOnly writes a new index the same way Save does, but skips the
+// bloom filter sidecar. It is used for the partial indexes NewIncremental
+// checkpoints every opts.CheckpointEvery packs: each batch ends up a different
+// size, so its filter would have different (m, k) than its siblings and
+// could never merge with them in loadFilter, guaranteeing an
+// errFilterNotFound/errBloomDimensionMismatch fallback to a full rescan on
+// the very next Load(). Skipping the sidecar for these batches means
+// Load() falls back the same way it would for any other index missing a
+// filter, rather than manufacturing sidecars that can never be used.
+func saveIndexOnly(repo *repository.Repository, packs map[backend.ID][]pack.Blob, supersedes backend.IDs) (backend.ID, error) {
+	return save(repo, packs, supersedes, false)
+}
+
+func save(repo *repository.Repository, packs map[backend.ID][]pack.Blob, supersedes backend.IDs, withFilter bool) (backend.ID, error) {
+	idxJSON := indexJSON{
+		Supersedes: supersedes,
+	}
+
+	idx := &Index{
+		Packs: make(map[backend.ID]Pack),
+		Blobs: make(map[backend.ID]map[pack.BlobType]Blob),
+	}
+
+	for packID, entries := range packs {
+		idx.storePack(packID, entries)
+
+		blobs := make([]blobJSON, 0, len(entries))
+		for _, entry := range entries {
+			blobs = append(blobs, blobJSON{
+				ID:     entry.ID,
+				Type:   entry.Type,
+				Offset: entry.Offset,
+				Length: entry.Length,
+			})
+		}
+
+		idxJSON.Packs = append(idxJSON.Packs, packJSON{ID: packID, Blobs: blobs})
+	}
+
+	blob, err := repo.SaveJSONUnpacked(backend.Index, idxJSON)
+	if err != nil {
+		return backend.ID{}, err
+	}
+
+	if withFilter {
+		idx.buildFilter()
+		if err := idx.saveFilter(repo, blob); err != nil {
+			// the sidecar filter is purely an optimization, losing it just
+			// means Load() will rebuild it from the index contents.
+			debug.Log("index.Save", "unable to save bloom filter for index %v: %v", blob.Str(), err)
+		}
+	}
+
+	return blob, nil
+}
+
+var errFilterNotFound = errors.New("no bloom filter sidecar for this index")
+
+// saveFilter persists idx.filter as a sidecar blob under its own
+// backend.Filter namespace, named after the index it belongs to. Keeping
+// filters out of backend.Index means Load()'s enumeration of backend.Index
+// never has to skip over, or risk mis-decoding, a non-index entry.
+func (idx *Index) saveFilter(repo *repository.Repository, indexID backend.ID) error {
+	if idx.filter == nil {
+		return nil
+	}
+
+	data, err := idx.filter.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	_, err = repo.Backend().Save(backend.Filter, indexID.String(), data)
+	return err
+}
+
+// loadFilter reconstructs the bloom filter sidecars for every index id
+// already present in idx.IndexIDs, merging them into a single filter. If
+// any sidecar is missing, errFilterNotFound is returned so that the caller
+// can fall back to rebuilding the filter from scratch.
+func (idx *Index) loadFilter(repo *repository.Repository) error {
+	merged := newBloomFilter(len(idx.Blobs), defaultFalsePositiveRate)
+
+	for id := range idx.IndexIDs {
+		rd, err := repo.Backend().Get(backend.Filter, id.String())
+		if err != nil {
+			return errFilterNotFound
+		}
+
+		data, err := io.ReadAll(rd)
+		rd.Close()
+		if err != nil {
+			return err
+		}
+
+		var filter bloomFilter
+		if err := filter.UnmarshalBinary(data); err != nil {
+			return err
+		}
+
+		// Sidecars are sized from the blob count of the index they were
+		// saved with, so two sidecars from differently-sized indexes
+		// will generally have different (m, k) and cannot be merged bit
+		// for bit. Surface that as an error instead of producing a
+		// corrupt, always-empty merged filter: the caller falls back to
+		// buildFilter(), which rescans idx.Blobs from scratch.
+		if err := merged.Merge(&filter); err != nil {
+			return fmt.Errorf("merging bloom filter for index %v: %v", id.Str(), err)
+		}
+	}
+
+	idx.filter = merged
+	return nil
+}
@@ -49,6 +49,23 @@ func TestIndexNew(t *testing.T) {
 	}
 
 	validateIndex(t, repo, idx)
+
+	if idx.filter == nil {
+		t.Errorf("New() did not build a bloom filter")
+	}
+
+	var unknown restic.ID
+	if idx.Has(unknown, pack.Data) {
+		t.Errorf("Has() reported a blob that was never added")
+	}
+
+	for id, types := range idx.Blobs {
+		for t2 := range types {
+			if !idx.Has(id, t2) {
+				t.Errorf("Has() did not find blob %v (%v) that is present in the index", id.Str(), t2)
+			}
+		}
+	}
 }
 
 func TestIndexLoad(t *testing.T) {
@@ -236,4 +253,79 @@ func TestIndexSave(t *testing.T) {
 			t.Errorf("pack %v is not contained in new index", id.Str())
 		}
 	}
+
+	if err := idx2.loadFilter(repo); err != nil || idx2.filter == nil {
+		t.Errorf("loaded index did not round-trip the bloom filter sidecar: %v", err)
+	}
+
+	for id, types := range idx2.Blobs {
+		for t := range types {
+			if !idx2.Has(id, t) {
+				t.Errorf("Has() did not find blob %v (%v) after loading the bloom filter sidecar", id.Str(), t)
+			}
+		}
+	}
+}
+
+// TestIndexLoadMismatchedFilterSidecars covers the case Merge cannot
+// handle: two saved indexes with different blob counts, whose bloom
+// filter sidecars therefore have different (m, k). Load() must detect the
+// mismatch and fall back to rebuilding the filter from the loaded blobs
+// rather than leaving idx.filter non-nil but unusable.
+func TestIndexLoadMismatchedFilterSidecars(t *testing.T) {
+	repo, cleanup := createFilledRepo(t, 3, 0)
+	defer cleanup()
+
+	full, err := New(repo)
+	if err != nil {
+		t.Fatalf("New() returned error %v", err)
+	}
+	if len(full.Packs) < 2 {
+		t.Skip("need at least 2 packs to split across differently-sized indexes")
+	}
+
+	done := make(chan struct{})
+	for id := range repo.List(backend.Index, done) {
+		if err := repo.Backend().Remove(backend.Index, id.String()); err != nil {
+			t.Fatalf("removing existing index %v: %v", id.Str(), err)
+		}
+	}
+	close(done)
+
+	packIDs := make([]backend.ID, 0, len(full.Packs))
+	for id := range full.Packs {
+		packIDs = append(packIDs, id)
+	}
+
+	// split unevenly so the two saved indexes end up with different blob
+	// counts, and therefore different bloom filter dimensions.
+	small := map[backend.ID][]pack.Blob{packIDs[0]: full.Packs[packIDs[0]].Entries}
+	rest := make(map[backend.ID][]pack.Blob)
+	for _, id := range packIDs[1:] {
+		rest[id] = full.Packs[id].Entries
+	}
+
+	if _, err := Save(repo, small, nil); err != nil {
+		t.Fatalf("unable to save first index: %v", err)
+	}
+	if _, err := Save(repo, rest, nil); err != nil {
+		t.Fatalf("unable to save second index: %v", err)
+	}
+
+	idx2, err := Load(repo)
+	if err != nil {
+		t.Fatalf("Load() returned error %v", err)
+	}
+
+	if idx2.filter == nil {
+		t.Fatalf("Load() left idx.filter nil")
+	}
+
+	for id, types := range idx2.Blobs {
+		for bt := range types {
+			if !idx2.Has(id, bt) {
+				t.Errorf("Has() reported a false negative for blob %v (%v) after loading mismatched filter sidecars", id.Str(), bt)
+			}
+		}
+	}
 }